@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pganalyze/collector/output/pganalyze_collector"
@@ -35,6 +36,9 @@ var LogLineCounterRegexp = `(\d+)`                                     // %l
 // - %c (session ID)
 // - %s (process start timestamp)
 // - %x (transaction ID)
+// These aren't in logLinePrefixSpecifiers either: state.LogLine has nowhere
+// to put them yet, so leaving them unsupported fails prefix compilation
+// loudly instead of silently dropping the captured value.
 
 var LevelAndContentRegexp = `(\w+):\s+(.*\n?)$`
 var LogPrefixAmazonRdsRegxp = regexp.MustCompile(`^` + TimeRegexp + `:` + IpAndPortRegexp + `:` + UserRegexp + `@` + DbRegexp + `:\[` + PidRegexp + `\]:` + LevelAndContentRegexp)
@@ -50,6 +54,185 @@ var RsyslogHostnameRegxp = `(\S+)`
 var RsyslogProcessNameRegexp = `(\w+)`
 var RsyslogRegexp = regexp.MustCompile(`^` + RsyslogTimeRegexp + ` ` + RsyslogHostnameRegxp + ` ` + RsyslogProcessNameRegexp + `\[` + PidRegexp + `\]: ` + SyslogSequenceAndSplitRegexp + ` ` + RsyslogLevelAndContentRegexp)
 
+// logLinePrefixSpecifiers maps a log_line_prefix %-specifier to the regexp
+// used to capture its value. %q is handled separately by CompileLogPrefix,
+// since it doesn't capture anything itself.
+var logLinePrefixSpecifiers = map[byte]string{
+	't': TimeRegexp,
+	'm': TimeRegexp,
+	'p': PidRegexp,
+	'u': UserRegexp,
+	'd': DbRegexp,
+	'a': AppRegexp,
+	'r': IpAndPortRegexp,
+	'v': VirtualTxRegexp,
+	'l': LogLineCounterRegexp,
+}
+
+// CompiledLogPrefix is a user-supplied log_line_prefix setting that has been
+// translated into a regexp, so that prefixes other than the hardcoded
+// LogPrefix* constants above can be matched against log lines without
+// requiring a code change.
+type CompiledLogPrefix struct {
+	prefix     string
+	regexp     *regexp.Regexp
+	specifiers []byte // which %-specifier each capture group belongs to, in order
+}
+
+// Note: this generic prefix compiler is the only piece of the user-defined
+// log_line_prefix request implemented so far. The streaming Feed/Flush
+// parser, sqlcommenter/traceparent extraction, the hand-written
+// delimiter-aware tokenizer, severity/jsonlog inference, and the pluggable
+// LineParser registry described in the same request are separate, larger
+// pieces of work and remain open.
+//
+// CompileLogPrefix translates a Postgres log_line_prefix string (e.g.
+// "%t [%p]: [%l-1] user=%u,db=%d ") into a CompiledLogPrefix that can match
+// lines produced by that prefix. Literal characters between specifiers are
+// matched exactly, and %q marks everything parsed so far as optional (it is
+// only emitted for session-attached processes).
+func CompileLogPrefix(prefix string) (*CompiledLogPrefix, error) {
+	var pattern strings.Builder
+	var specifiers []byte
+	optionalFrom := -1
+
+	pattern.WriteString("^")
+
+	runes := []rune(prefix)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '%' || i == len(runes)-1 {
+			pattern.WriteString(regexp.QuoteMeta(string(runes[i])))
+			continue
+		}
+
+		i++
+		specifier := byte(runes[i])
+		if specifier == 'q' {
+			optionalFrom = pattern.Len()
+			continue
+		}
+		if specifier == '%' {
+			pattern.WriteString(regexp.QuoteMeta("%"))
+			continue
+		}
+
+		specRegexp, ok := logLinePrefixSpecifiers[specifier]
+		if !ok {
+			return nil, fmt.Errorf("unsupported log_line_prefix specifier: %%%c", specifier)
+		}
+		pattern.WriteString(specRegexp)
+		specifiers = append(specifiers, specifier)
+	}
+
+	patternStr := pattern.String()
+	if optionalFrom != -1 {
+		patternStr = patternStr[:optionalFrom] + "(?:" + patternStr[optionalFrom:] + ")?"
+	}
+	patternStr += LevelAndContentRegexp
+
+	re, err := regexp.Compile(patternStr)
+	if err != nil {
+		return nil, fmt.Errorf("could not compile log_line_prefix %q: %s", prefix, err)
+	}
+
+	return &CompiledLogPrefix{prefix: prefix, regexp: re, specifiers: specifiers}, nil
+}
+
+type compiledLogPrefixCacheEntry struct {
+	compiled *CompiledLogPrefix
+	err      error
+}
+
+var compiledLogPrefixMutex sync.Mutex
+var compiledLogPrefixCache = map[string]compiledLogPrefixCacheEntry{}
+
+// compiledLogPrefixFor returns a cached CompiledLogPrefix for the given
+// prefix string, compiling and caching it (including failures, so an
+// unsupported prefix isn't recompiled on every line) on first use.
+func compiledLogPrefixFor(prefix string) (*CompiledLogPrefix, error) {
+	compiledLogPrefixMutex.Lock()
+	defer compiledLogPrefixMutex.Unlock()
+
+	if entry, ok := compiledLogPrefixCache[prefix]; ok {
+		return entry.compiled, entry.err
+	}
+
+	compiled, err := CompileLogPrefix(prefix)
+	compiledLogPrefixCache[prefix] = compiledLogPrefixCacheEntry{compiled: compiled, err: err}
+	return compiled, err
+}
+
+// Parse matches line against the compiled prefix and extracts whichever
+// fields the prefix exposes into a state.LogLine. As with the hardcoded
+// prefixes in ParseLogLineWithPrefix, ok is false both when the prefix
+// doesn't match (the line is assumed to be a continuation) and when the
+// matched line has no log level.
+func (c *CompiledLogPrefix) Parse(line string) (logLine state.LogLine, ok bool) {
+	parts := c.regexp.FindStringSubmatch(line)
+	if parts == nil {
+		logLine.Content = line
+		return
+	}
+
+	var timePart, userPart, dbPart, appPart, pidPart string
+	for i, specifier := range c.specifiers {
+		value := parts[i+1]
+		switch specifier {
+		case 't', 'm':
+			timePart = value
+		case 'u':
+			userPart = value
+		case 'd':
+			dbPart = value
+		case 'a':
+			appPart = value
+		case 'p':
+			pidPart = value
+		}
+	}
+
+	levelPart := parts[len(parts)-2]
+	contentPart := parts[len(parts)-1]
+
+	return populateLogLine(timePart, "2006-01-02 15:04:05 MST", userPart, dbPart, appPart, pidPart, levelPart, contentPart)
+}
+
+// populateLogLine fills in the fields of a state.LogLine shared by all of
+// the prefix-matching strategies above, once each has extracted the raw
+// string value of every specifier it understands.
+func populateLogLine(timePart string, timeFormat string, userPart string, dbPart string, appPart string, pidPart string, levelPart string, contentPart string) (logLine state.LogLine, ok bool) {
+	var err error
+	logLine.OccurredAt, err = time.Parse(timeFormat, timePart)
+	if err != nil {
+		ok = false
+		return
+	}
+
+	if userPart != "[unknown]" {
+		logLine.Username = userPart
+	}
+	if dbPart != "[unknown]" {
+		logLine.Database = dbPart
+	}
+	if appPart != "[unknown]" {
+		logLine.Application = appPart
+	}
+
+	backendPid, _ := strconv.Atoi(pidPart)
+	logLine.BackendPid = int32(backendPid)
+	logLine.Content = contentPart
+
+	// This is actually a continuation of a previous line
+	if levelPart == "" {
+		return
+	}
+
+	logLine.LogLevel = pganalyze_collector.LogLineInformation_LogLevel(pganalyze_collector.LogLineInformation_LogLevel_value[levelPart])
+	ok = true
+
+	return
+}
+
 func ParseLogLineWithPrefix(prefix string, line string) (logLine state.LogLine, ok bool) {
 	var timePart, userPart, dbPart, appPart, pidPart, levelPart, contentPart string
 
@@ -132,41 +315,25 @@ func ParseLogLineWithPrefix(prefix string, line string) (logLine state.LogLine,
 			levelPart = parts[6]
 			contentPart = parts[7]
 		default:
-			// Some callers use the content of unparsed lines to stitch multi-line logs together
-			logLine.Content = line
-		}
-	}
-
-	var err error
-	logLine.OccurredAt, err = time.Parse(timeFormat, timePart)
-	if err != nil {
-		ok = false
-		return
-	}
-
-	if userPart != "[unknown]" {
-		logLine.Username = userPart
-	}
-	if dbPart != "[unknown]" {
-		logLine.Database = dbPart
-	}
-	if appPart != "[unknown]" {
-		logLine.Application = appPart
-	}
-
-	backendPid, _ := strconv.Atoi(pidPart)
-	logLine.BackendPid = int32(backendPid)
-	logLine.Content = contentPart
+			if prefix == "" {
+				// Some callers use the content of unparsed lines to stitch multi-line logs together
+				logLine.Content = line
+				return
+			}
 
-	// This is actually a continuation of a previous line
-	if levelPart == "" {
-		return
+			// A user-supplied log_line_prefix that isn't one of the built-ins
+			// above: compile it into a regexp (cached by prefix string) and
+			// match directly, instead of requiring a hardcoded LogPrefix*Regexp.
+			compiled, err := compiledLogPrefixFor(prefix)
+			if err != nil {
+				logLine.Content = line
+				return
+			}
+			return compiled.Parse(line)
+		}
 	}
 
-	logLine.LogLevel = pganalyze_collector.LogLineInformation_LogLevel(pganalyze_collector.LogLineInformation_LogLevel_value[levelPart])
-	ok = true
-
-	return
+	return populateLogLine(timePart, timeFormat, userPart, dbPart, appPart, pidPart, levelPart, contentPart)
 }
 
 func ParseAndAnalyzeBuffer(buffer string, initialByteStart int64, linesNewerThan time.Time) ([]state.LogLine, []state.PostgresQuerySample, int64) {
@@ -0,0 +1,85 @@
+package logs
+
+import "testing"
+
+func TestCompileLogPrefix_CustomPrefixMatches(t *testing.T) {
+	compiled, err := CompileLogPrefix("%t [%p]: [%l-1] user=%u,db=%d ")
+	if err != nil {
+		t.Fatalf("CompileLogPrefix returned error: %s", err)
+	}
+
+	line := "2021-06-01 12:00:00 UTC [1234]: [1-1] user=myuser,db=mydb LOG:  duration: 1.234 ms\n"
+	logLine, ok := compiled.Parse(line)
+	if !ok {
+		t.Fatalf("expected line to parse, got ok=false")
+	}
+	if logLine.Username != "myuser" {
+		t.Errorf("expected username %q, got %q", "myuser", logLine.Username)
+	}
+	if logLine.Database != "mydb" {
+		t.Errorf("expected database %q, got %q", "mydb", logLine.Database)
+	}
+	if logLine.BackendPid != 1234 {
+		t.Errorf("expected backend pid %d, got %d", 1234, logLine.BackendPid)
+	}
+	if logLine.Content != "duration: 1.234 ms\n" {
+		t.Errorf("expected content %q, got %q", "duration: 1.234 ms\n", logLine.Content)
+	}
+}
+
+func TestCompileLogPrefix_UnsupportedSpecifier(t *testing.T) {
+	_, err := CompileLogPrefix("%t [%p] %e ")
+	if err == nil {
+		t.Fatal("expected an error for an unsupported specifier, got nil")
+	}
+}
+
+func TestCompileLogPrefix_OptionalQSpecifier(t *testing.T) {
+	compiled, err := CompileLogPrefix("%m [%p][%v] : [%l-1] %q[app=%a] ")
+	if err != nil {
+		t.Fatalf("CompileLogPrefix returned error: %s", err)
+	}
+
+	withApp := "2021-06-01 12:00:00.000 UTC [1234][2/3] : [1-1] [app=myapp] LOG:  statement: select 1\n"
+	logLine, ok := compiled.Parse(withApp)
+	if !ok {
+		t.Fatalf("expected line with app to parse, got ok=false")
+	}
+	if logLine.Application != "myapp" {
+		t.Errorf("expected application %q, got %q", "myapp", logLine.Application)
+	}
+
+	withoutApp := "2021-06-01 12:00:00.000 UTC [1234][2/3] : [1-1] LOG:  statement: select 1\n"
+	logLine, ok = compiled.Parse(withoutApp)
+	if !ok {
+		t.Fatalf("expected line without app to parse, got ok=false")
+	}
+	if logLine.Application != "" {
+		t.Errorf("expected empty application, got %q", logLine.Application)
+	}
+}
+
+func TestCompiledLogPrefixFor_CachesFailure(t *testing.T) {
+	prefix := "%t [%p] %e "
+
+	first, firstErr := compiledLogPrefixFor(prefix)
+	if firstErr == nil {
+		t.Fatal("expected an error, got nil")
+	}
+
+	second, secondErr := compiledLogPrefixFor(prefix)
+	if secondErr == nil {
+		t.Fatal("expected the cached error on the second call, got nil")
+	}
+	if first != second {
+		t.Errorf("expected the same (nil) compiled prefix from cache, got %v and %v", first, second)
+	}
+
+	entry, ok := compiledLogPrefixCache[prefix]
+	if !ok {
+		t.Fatal("expected the failed compilation to be cached")
+	}
+	if entry.err == nil {
+		t.Error("expected the cached entry to carry the compile error")
+	}
+}